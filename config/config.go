@@ -0,0 +1,54 @@
+/* Server configuration. */
+
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package config holds goiardi's server-wide configuration, populated from
+// command line flags and/or a config file at startup. It's a single
+// package-level Conf value rather than something threaded through every
+// call, the same way the rest of goiardi does it.
+package config
+
+import "time"
+
+// Conf holds every server-wide setting goiardi reads at run time.
+type Conf struct {
+	// UseMySQL selects the MySQL-backed Store over the in-memory one.
+	UseMySQL bool
+	// UsePostgreSQL selects the Postgres-backed Store over the in-memory
+	// one. Mutually exclusive with UseMySQL.
+	UsePostgreSQL bool
+
+	// NodeReapInterval is the cron spec (e.g. "@every 5m") the node
+	// reaper runs its sweep on.
+	NodeReapInterval string
+	// NodeStaleAfter is how long a node can go without checking in
+	// before the reaper marks it stale.
+	NodeStaleAfter time.Duration
+	// NodeReapAfter is how long a node can go without checking in
+	// before the reaper deletes it outright.
+	NodeReapAfter time.Duration
+
+	// IndexWorkers is how many goroutines drain the async indexing
+	// queue. Falls back to 2 if unset.
+	IndexWorkers int
+	// IndexDropOldest selects drop-oldest backpressure for the indexing
+	// queue over the default of blocking the enqueuing caller.
+	IndexDropOldest bool
+}
+
+// Config is the running server's configuration, filled in at startup.
+var Config = &Conf{}
@@ -0,0 +1,195 @@
+/* Asynchronous indexing pipeline. */
+
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package indexer
+
+import (
+	"github.com/ctdk/goiardi/config"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// Indexable is anything IndexObj/DeleteItemFromCollection already know
+// how to index -- the DocId/Index/Flatten trio node.Node (and the other
+// indexed types) expose.
+type Indexable interface {
+	DocId() string
+	Index() string
+	Flatten() []string
+}
+
+type queueEntry struct {
+	deleted bool
+	index   string
+	id      string
+	obj     Indexable
+}
+
+// Queue is a bounded, coalescing async front-end for IndexObj and
+// DeleteItemFromCollection. Save()/Delete() used to call those directly
+// and synchronously; on a large flattened attribute map, gtrie.Create is
+// expensive enough that a chatty chef-client run shouldn't block on it
+// once per attribute save. Repeated saves of the same object that are
+// still queued when a later save comes in collapse into a single
+// rebuild.
+type Queue struct {
+	mu         sync.Mutex
+	pending    map[string]*queueEntry
+	notify     chan string
+	dropOldest bool
+	inflight   sync.WaitGroup
+	enqueued   uint64
+	processed  uint64
+	dropped    uint64
+}
+
+var defaultQueue *Queue
+var once sync.Once
+
+// newQueue builds a Queue with `workers` goroutines draining a backlog of
+// the given capacity. When dropOldest is false, a full backlog blocks the
+// enqueuing caller (back-pressure); when true, the oldest still-queued
+// key is evicted to make room instead.
+func newQueue(workers int, capacity int, dropOldest bool) *Queue {
+	if workers < 1 {
+		workers = 1
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+	q := &Queue{
+		pending:    make(map[string]*queueEntry),
+		notify:     make(chan string, capacity),
+		dropOldest: dropOldest,
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Default returns the package-wide Queue, sized from
+// config.Config.IndexWorkers (falling back to two workers if it's
+// unset).
+func Default() *Queue {
+	once.Do(func() {
+		workers := config.Config.IndexWorkers
+		if workers < 1 {
+			workers = 2
+		}
+		defaultQueue = newQueue(workers, workers*32, config.Config.IndexDropOldest)
+	})
+	return defaultQueue
+}
+
+func (q *Queue) enqueue(e *queueEntry) {
+	key := e.index + "/" + e.id
+	q.mu.Lock()
+	_, exists := q.pending[key]
+	q.pending[key] = e
+	q.mu.Unlock()
+
+	if exists {
+		// Already queued for a worker; it'll pick up this newer
+		// entry when it gets there, so there's nothing else to do.
+		return
+	}
+
+	q.inflight.Add(1)
+	atomic.AddUint64(&q.enqueued, 1)
+	select {
+	case q.notify <- key:
+	default:
+		if q.dropOldest {
+			select {
+			case droppedKey := <-q.notify:
+				q.mu.Lock()
+				delete(q.pending, droppedKey)
+				q.mu.Unlock()
+				q.inflight.Done()
+				atomic.AddUint64(&q.dropped, 1)
+			default:
+			}
+			q.notify <- key
+		} else {
+			q.notify <- key // back-pressure: block until there's room
+		}
+	}
+}
+
+func (q *Queue) work() {
+	for key := range q.notify {
+		q.mu.Lock()
+		e, ok := q.pending[key]
+		if ok {
+			delete(q.pending, key)
+		}
+		q.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if e.deleted {
+			if err := DeleteItemFromCollection(e.index, e.id); err != nil {
+				log.Printf("indexer: async delete of %s/%s failed: %s", e.index, e.id, err.Error())
+			}
+		} else {
+			IndexObj(e.obj)
+		}
+		atomic.AddUint64(&q.processed, 1)
+		q.inflight.Done()
+	}
+}
+
+// IndexObjAsync queues obj for indexing on the default Queue instead of
+// rebuilding its trie inline.
+func IndexObjAsync(obj Indexable) {
+	Default().enqueue(&queueEntry{index: obj.Index(), id: obj.DocId(), obj: obj})
+}
+
+// DeleteAsync queues removal of index/id from the search index on the
+// default Queue.
+func DeleteAsync(index string, id string) {
+	Default().enqueue(&queueEntry{deleted: true, index: index, id: id})
+}
+
+// Flush blocks until every job already queued on the default Queue has
+// been processed. It's meant to be called during SIGTERM shutdown,
+// before SaveIndex persists the index to disk, so an in-flight save
+// doesn't get lost.
+func Flush() {
+	Default().inflight.Wait()
+}
+
+// Stats is a snapshot of a Queue's running counters, handy for exposing
+// over a metrics endpoint.
+type Stats struct {
+	Enqueued  uint64
+	Processed uint64
+	Dropped   uint64
+}
+
+// QueueStats returns a snapshot of the default Queue's counters.
+func QueueStats() Stats {
+	q := Default()
+	return Stats{
+		Enqueued:  atomic.LoadUint64(&q.enqueued),
+		Processed: atomic.LoadUint64(&q.processed),
+		Dropped:   atomic.LoadUint64(&q.dropped),
+	}
+}
@@ -0,0 +1,77 @@
+/* Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package indexer
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestEnqueueDropOldestClearsPendingAndInflight guards against the bug
+// fixed in 0e8a787: dropping the oldest notify token without also
+// clearing that key out of pending and calling inflight.Done() for it
+// orphaned the job forever and left Flush() unable to ever return.
+//
+// This builds a Queue by hand, with no worker goroutines draining
+// notify, so enqueue's drop-oldest branch is exercised deterministically
+// instead of racing a real worker.
+func TestEnqueueDropOldestClearsPendingAndInflight(t *testing.T) {
+	q := &Queue{
+		pending:    make(map[string]*queueEntry),
+		notify:     make(chan string, 2),
+		dropOldest: true,
+	}
+
+	q.enqueue(&queueEntry{index: "node", id: "a"})
+	q.enqueue(&queueEntry{index: "node", id: "b"})
+	// notify is now full with "node/a" and "node/b"; this third enqueue
+	// has to drop "node/a" to make room for "node/c".
+	q.enqueue(&queueEntry{index: "node", id: "c"})
+
+	if atomic.LoadUint64(&q.dropped) != 1 {
+		t.Fatalf("expected dropped count of 1, got %d", q.dropped)
+	}
+
+	q.mu.Lock()
+	_, stillPending := q.pending["node/a"]
+	_, bPending := q.pending["node/b"]
+	_, cPending := q.pending["node/c"]
+	q.mu.Unlock()
+	if stillPending {
+		t.Errorf("dropped entry node/a should have been removed from pending")
+	}
+	if !bPending || !cPending {
+		t.Errorf("node/b and node/c should still be pending")
+	}
+
+	// Only "b" and "c" are still in flight -- if the dropped entry's
+	// Done() was never called, this will leave inflight permanently at
+	// 1 and the Wait() below will hang instead of returning.
+	q.inflight.Done()
+	q.inflight.Done()
+
+	done := make(chan struct{})
+	go func() {
+		q.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("inflight.Wait() did not return -- dropped entry's Done() was never called")
+	}
+}
@@ -20,16 +20,20 @@
 package node
 
 import (
-	"github.com/ctdk/goiardi/config"
-	"github.com/ctdk/goiardi/data_store"
 	"github.com/ctdk/goiardi/util"
 	"github.com/ctdk/goiardi/indexer"
+	"github.com/ctdk/goiardi/policy"
 	"fmt"
 	"net/http"
-	"log"
-	"database/sql"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// now is time.Now, indirected so tests can swap in a fixed clock instead
+// of relying on real sleeps to exercise Touch/GetStale/the reaper.
+var now = time.Now
+
 type Node struct {
 	Name string `json:"name"`
 	ChefEnvironment string `json:"chef_environment"`
@@ -40,37 +44,84 @@ type Node struct {
 	Normal map[string]interface{} `json:"normal"`
 	Default map[string]interface{} `json:"default"`
 	Override map[string]interface{} `json:"override"`
+	// ResourceVersion is bumped every time the node is saved, and is
+	// used as an ETag/If-Match style guard so two clients can't
+	// silently clobber each other's read-modify-write of a node's
+	// attribute trees.
+	ResourceVersion uint64 `json:"_version"`
+	// LastCheckIn is updated every time a chef-client posts a run or
+	// status update for this node, regardless of whether the run
+	// succeeded.
+	LastCheckIn time.Time `json:"last_check_in"`
+	// LastSuccessfulRun is only updated when the posted run status was
+	// successful.
+	LastSuccessfulRun time.Time `json:"last_successful_run"`
+	// LastRunStatus is whatever status string the chef-client run
+	// posted most recently (e.g. "success", "failure").
+	LastRunStatus string `json:"last_run_status"`
+	// Stale is set by the reaper once a node has gone quiet for longer
+	// than config.Config.NodeStaleAfter, and is indexed so it can be
+	// searched on (e.g. "stale:true").
+	Stale bool `json:"stale"`
+	// PolicyName, PolicyGroup, and PolicyRevision are Chef 12's
+	// policyfile fields. When PolicyName and PolicyGroup are both set,
+	// expansion should consult the pinned policy revision (see the
+	// policy package) instead of RunList/ChefEnvironment.
+	PolicyName string `json:"policy_name"`
+	PolicyGroup string `json:"policy_group"`
+	PolicyRevision string `json:"policy_revision"`
+	// store is the persistence backend this node was built against.
+	// It's nil for nodes fetched the ordinary way, in which case every
+	// method falls back to the package's defaultStore(); it's only set
+	// when the node was constructed with WithStore, which is mainly
+	// useful for tests and for callers plugging in an alternate
+	// backend.
+	store Store `json:"-"`
 }
 
-func New(name string) (*Node, util.Gerror) {
-	/* check for an existing node with this name */
-	if config.Config.UseMySQL {
-		// will need redone if orgs ever get implemented
-		_, err := data_store.CheckForOne(data_store.Dbh, "nodes", name)
-		if err == nil {
-			gerr := util.Errorf("Node %s already exists", name)
-			gerr.SetStatus(http.StatusConflict)
-			return nil, gerr
-		} else {
-			if err != sql.ErrNoRows {
-				gerr := util.Errorf(err.Error())
-				gerr.SetStatus(http.StatusInternalServerError)
-				return nil, gerr
-			}
-		}
-	} else {
-		ds := data_store.New()
-		if _, found := ds.Get("node", name); found {
-			err := util.Errorf("Node %s already exists", name)
-			err.SetStatus(http.StatusConflict)
-			return nil, err
-		}
+// Option configures a Node being built by New. The options that set a
+// plain field (WithEnvironment, WithRunList, WithNormalAttrs, ...) are
+// just a friendlier way of assigning what NewFromJson would otherwise
+// have to pass in as a whole JSON blob; WithStore is the seam that lets
+// a caller point a node at a persistence backend other than the
+// package-wide default.
+type Option func(*Node)
+
+// WithEnvironment sets the new node's chef_environment.
+func WithEnvironment(env string) Option {
+	return func(n *Node) {
+		n.ChefEnvironment = env
 	}
-	if !util.ValidateDBagName(name){
-		err := util.Errorf("Field 'name' invalid")
-		return nil, err
+}
+
+// WithRunList sets the new node's run list.
+func WithRunList(runList []string) Option {
+	return func(n *Node) {
+		n.RunList = runList
+	}
+}
+
+// WithNormalAttrs sets the new node's normal attributes.
+func WithNormalAttrs(attrs map[string]interface{}) Option {
+	return func(n *Node) {
+		n.Normal = attrs
+	}
+}
+
+// WithStore points the new node at a specific Store, rather than
+// whichever one defaultStore() would otherwise pick based on
+// config.Config. Save(), Delete(), and the existence check in New()
+// itself all honor it. The package-level reads (Get, GetList, GetStale)
+// have no *Node to carry that store on, so they take the same Store as
+// an optional trailing argument instead -- pass it the store a node was
+// built with to read it back through that same backend.
+func WithStore(s Store) Option {
+	return func(n *Node) {
+		n.store = s
 	}
-	/* No node, we make a new one */
+}
+
+func New(name string, opts ...Option) (*Node, util.Gerror) {
 	node := &Node{
 		Name: name,
 		ChefEnvironment: "_default",
@@ -82,6 +133,35 @@ func New(name string) (*Node, util.Gerror) {
 		Default: map[string]interface{}{},
 		Override: map[string]interface{}{},
 	}
+	for _, opt := range opts {
+		opt(node)
+	}
+
+	store := node.store
+	if store == nil {
+		store = defaultStore()
+	}
+
+	/* check for an existing node with this name */
+	// will need redone if orgs ever get implemented
+	found, err := store.CheckExists(name)
+	if err != nil {
+		return nil, internalErr(err)
+	}
+	if found {
+		gerr := util.Errorf("Node %s already exists", name)
+		gerr.SetStatus(http.StatusConflict)
+		return nil, gerr
+	}
+	if !util.ValidateDBagName(name){
+		err := util.Errorf("Field 'name' invalid")
+		return nil, err
+	}
+	// A node that hasn't run chef-client yet has no LastCheckIn of its
+	// own; without this it defaults to the zero Time, which GetStale
+	// would treat as infinitely old and the reaper would delete on its
+	// very first pass.
+	node.LastCheckIn = now()
 	return node, nil
 }
 
@@ -95,105 +175,39 @@ func NewFromJson(json_node map[string]interface{}) (*Node, util.Gerror){
 	if err != nil {
 		return nil, err
 	}
-	err = node.UpdateFromJson(json_node)
+	err = node.UpdateFromJson(json_node, "")
 	if err != nil {
 		return nil, err
 	}
 	return node, nil
 }
 
-// Fill in a node from a row returned from the SQL server. Useful for the case
-// down the road where an array of objects is needed, but building it with
-// a call to GetList(), then repeated calls to Get() sucks with a real db even
-// if it's marginally acceptable in in-memory mode.
-//
-// NB: This does require the query to look like the one in Get().
-func (n *Node) fillNodeFromSQL(row *sql.Row) error {
-	if config.Config.UseMySQL {
-		var (
-			rl []byte
-			aa []byte
-			na []byte
-			da []byte
-			oa []byte
-		)
-		err := row.Scan(&n.Name, &n.ChefEnvironment, &rl, &aa, &na, &da, &oa)
-		if err != nil {
-			return err
-		}
-		n.ChefType = "node"
-		n.JsonClass = "Chef::Node"
-		var q interface{}
-		q, err = data_store.DecodeBlob(rl, n.RunList)
-		if err != nil {
-			return err
-		}
-		n.RunList = q.([]string)
-		q, err = data_store.DecodeBlob(aa, n.Automatic)
-		if err != nil {
-			return err
-		}
-		n.Automatic = q.(map[string]interface{})
-		q, err = data_store.DecodeBlob(na, n.Normal)
-		if err != nil {
-			return err
-		}
-		n.Normal = q.(map[string]interface{})
-		q, err = data_store.DecodeBlob(da, n.Default)
-		if err != nil {
-			return err
-		}
-		n.Default = q.(map[string]interface{})
-		q, err = data_store.DecodeBlob(oa, n.Override)
-		if err != nil {
-			return err
-		}
-		n.Override = q.(map[string]interface{})
-		data_store.ChkNilArray(n)
-	} else { // add Postgres later
-		err := fmt.Errorf("no database configured, operating in in-memory mode -- fillNodeFromSQL cannot be run")
-		return err
-	}
-	return nil
+// Get fetches a node by name from store, if one is given, or else the
+// default Store (MySQL, Postgres, or in-memory, picked per config.Config --
+// see store.go). The optional store argument exists so a node saved via
+// WithStore can be read back through the same Store instead of always
+// hitting the process-wide default -- handy for tests and for alternative
+// backends that shouldn't otherwise have to be wired up globally.
+func Get(node_name string, store ...Store) (*Node, error) {
+	return pickStore(store).Get(node_name)
 }
 
-func Get(node_name string) (*Node, error) {
-	var node *Node
-	var found bool
-	if config.Config.UseMySQL {
-		node = new(Node)
-		stmt, err := data_store.Dbh.Prepare("select n.name, e.name as chef_environment, n.run_list, n.automatic_attr, n.normal_attr, n.default_attr, n.override_attr from nodes n join environments as e on n.environment_id = e.id where n.name = ?")
-		if err != nil {
-			return nil, err
-		}
-		defer stmt.Close()
-		row := stmt.QueryRow(node_name)
-		err = node.fillNodeFromSQL(row)
-
-		if err != nil {
-			if err == sql.ErrNoRows {
-				found = false
-			} else {
-				return nil, err
-			}
-		} else {
-			found = true
-		}
-	} else {
-		ds := data_store.New()
-		var n interface{}
-		n, found = ds.Get("node", node_name)
-		node = n.(*Node)
-	}
-	if !found {
-		err := fmt.Errorf("node '%s' not found", node_name)
-		return nil, err
+// pickStore returns the first non-nil Store in stores, or defaultStore()
+// if none was given -- the same fallback WithStore's callers already get
+// in New(), Save(), and Delete().
+func pickStore(stores []Store) Store {
+	if len(stores) > 0 && stores[0] != nil {
+		return stores[0]
 	}
-	return node, nil
+	return defaultStore()
 }
 
-// Update an existing node with the uploaded JSON.
-func (n *Node) UpdateFromJson(json_node map[string]interface{}) util.Gerror {
+// Update an existing node with the uploaded JSON. ifMatch is the raw value
+// of an If-Match header, if the caller sent one; if it doesn't match the
+// node's current ResourceVersion, the update is rejected with a 409
+// Conflict instead of clobbering whatever a concurrent chef-client run has
+// already saved.
+func (n *Node) UpdateFromJson(json_node map[string]interface{}, ifMatch string) util.Gerror {
 	/* It's actually totally legitimate to save a node with a different
 	 * name than you started with, but we need to get/create a new node for
 	 * it is all. */
@@ -206,12 +220,25 @@ func (n *Node) UpdateFromJson(json_node map[string]interface{}) util.Gerror {
 		return err
 	}
 
+	if ifMatch != "" {
+		expected, cerr := strconv.ParseUint(ifMatch, 10, 64)
+		if cerr != nil {
+			gerr := util.Errorf("If-Match header '%s' is not a valid resource version", ifMatch)
+			return gerr
+		}
+		if expected != n.ResourceVersion {
+			gerr := util.Errorf("Node %s has been modified since resource version %d was read (currently at %d)", n.Name, expected, n.ResourceVersion)
+			gerr.SetStatus(http.StatusConflict)
+			return gerr
+		}
+	}
+
 	/* Validations */
 
 	/* Look for invalid top level elements. *We* don't have to worry about
 	 * them, but chef-pedant cares (probably because Chef <=10 stores
  	 * json objects directly, dunno about Chef 11). */
-	valid_elements := []string{ "name", "json_class", "chef_type", "chef_environment", "run_list", "override", "normal", "default", "automatic" }
+	valid_elements := []string{ "name", "json_class", "chef_type", "chef_environment", "run_list", "override", "normal", "default", "automatic", "_version", "policy_name", "policy_group", "policy_revision" }
 	ValidElem:
 	for k, _ := range json_node {
 		for _, i := range valid_elements {
@@ -279,10 +306,60 @@ func (n *Node) UpdateFromJson(json_node map[string]interface{}) util.Gerror {
 		}
 	}
 
+	json_node["policy_name"], verr = util.ValidateAsFieldString(json_node["policy_name"])
+	if verr != nil {
+		if verr.Error() == "Field 'name' nil" {
+			json_node["policy_name"] = n.PolicyName
+		} else {
+			return verr
+		}
+	}
+
+	json_node["policy_group"], verr = util.ValidateAsFieldString(json_node["policy_group"])
+	if verr != nil {
+		if verr.Error() == "Field 'name' nil" {
+			json_node["policy_group"] = n.PolicyGroup
+		} else {
+			return verr
+		}
+	}
+
+	json_node["policy_revision"], verr = util.ValidateAsFieldString(json_node["policy_revision"])
+	if verr != nil {
+		if verr.Error() == "Field 'name' nil" {
+			json_node["policy_revision"] = n.PolicyRevision
+		} else {
+			return verr
+		}
+	}
+
+	/* Per Chef 12, policy_name and policy_group travel together, and a
+	 * policy revision is meaningless without them -- this is what makes
+	 * expansion use the policy's pinned run list instead of
+	 * chef_environment's. */
+	policyName := json_node["policy_name"].(string)
+	policyGroup := json_node["policy_group"].(string)
+	policyRevision := json_node["policy_revision"].(string)
+	if (policyName == "") != (policyGroup == "") {
+		verr = util.Errorf("policy_name and policy_group must both be set, or both left blank")
+		return verr
+	}
+	if policyName != "" && policyRevision == "" {
+		verr = util.Errorf("policy_revision must be set when policy_name and policy_group are")
+		return verr
+	}
+	if policyName == "" && policyRevision != "" {
+		verr = util.Errorf("policy_revision is meaningless without policy_name and policy_group")
+		return verr
+	}
+
 	/* and setting */
 	n.ChefEnvironment = json_node["chef_environment"].(string)
 	n.ChefType = json_node["chef_type"].(string)
 	n.JsonClass = json_node["json_class"].(string)
+	n.PolicyName = policyName
+	n.PolicyGroup = policyGroup
+	n.PolicyRevision = policyRevision
 	n.RunList = json_node["run_list"].([]string)
 	n.Normal = json_node["normal"].(map[string]interface{})
 	n.Automatic = json_node["automatic"].(map[string]interface{})
@@ -291,127 +368,110 @@ func (n *Node) UpdateFromJson(json_node map[string]interface{}) util.Gerror {
 	return nil
 }
 
-func (n *Node) Save() error {
-	if config.Config.UseMySQL {
-		// prepare the complex structures for saving
-		rlb, rlerr := data_store.EncodeBlob(n.RunList)
-		if rlerr != nil {
-			return rlerr
-		}
-		aab, aaerr := data_store.EncodeBlob(n.Automatic)
-		if aaerr != nil {
-			return aaerr
-		}
-		nab, naerr := data_store.EncodeBlob(n.Normal)
-		if naerr != nil {
-			return naerr
-		}
-		dab, daerr := data_store.EncodeBlob(n.Default)
-		if daerr != nil {
-			return daerr
-		}
-		oab, oaerr := data_store.EncodeBlob(n.Override)
-		if oaerr != nil {
-			return oaerr
-		}
+// internalErr wraps a lower-level error (SQL driver, encoding, etc.) as a
+// 500 Gerror, the same way New() already does for its own MySQL errors.
+func internalErr(err error) util.Gerror {
+	gerr := util.Errorf(err.Error())
+	gerr.SetStatus(http.StatusInternalServerError)
+	return gerr
+}
 
-		tx, err := data_store.Dbh.Begin()
-		var node_id int32
-		if err != nil {
-			return err
-		}
-		// This does not use the INSERT ... ON DUPLICATE KEY UPDATE
-		// syntax to keep the MySQL code & the future Postgres code
-		// closer together.
-		node_id, err = data_store.CheckForOne(tx, "nodes", n.Name)
-		if err == nil {
-			// probably want binlog_format set to MIXED or ROW for 
-			// this query
-			_, err := tx.Exec("UPDATE nodes n, environments e SET n.environment_id = e.id, n.run_list = ?, n.automatic_attr = ?, n.normal_attr = ?, n.default_attr = ?, n.override_attr = ?, n.updated_at = NOW() WHERE n.id = ? and e.name = ?", rlb, aab, nab, dab, oab, node_id, n.ChefEnvironment)
-			if err != nil {
-				tx.Rollback()
-				return err
-			}
-		} else {
-			if err != sql.ErrNoRows {
-				tx.Rollback()
-				return err
-			}
-			var environment_id int32
-			environment_id, err = data_store.CheckForOne(tx, "environments", n.ChefEnvironment)
-			if err != nil {
-				tx.Rollback()
-				return err
-			}
-			_, err = tx.Exec("INSERT INTO nodes (name, environment_id, run_list, automatic_attr, normal_attr, default_attr, override_attr, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, NOW(), NOW())", n.Name, environment_id, rlb, aab, nab, dab, oab)
-			if err != nil {
-				tx.Rollback()
-				return err
-			}
+// conflictErr builds the 409 Gerror returned when a Save() finds that the
+// node has moved on to a resource version the caller never saw.
+func (n *Node) conflictErr() util.Gerror {
+	gerr := util.Errorf("Node %s has been updated since resource version %d was read", n.Name, n.ResourceVersion)
+	gerr.SetStatus(http.StatusConflict)
+	return gerr
+}
+
+// Save persists the node through its Store, bumping ResourceVersion in
+// the process. The save is guarded: if the currently stored version
+// doesn't match the version n was loaded at, the Store rejects it with
+// ErrConflict and Save turns that into a 409 rather than letting the
+// write blindly overwrite a concurrent chef-client run's changes.
+func (n *Node) Save() util.Gerror {
+	store := n.store
+	if store == nil {
+		store = defaultStore()
+	}
+	if err := store.Put(n); err != nil {
+		if err == ErrConflict {
+			return n.conflictErr()
 		}
-		tx.Commit()
-	} else {
-		ds := data_store.New()
-		ds.Set("node", n.Name, n)
+		return internalErr(err)
 	}
-	/* TODO Later: excellent candidate for a goroutine */
-	indexer.IndexObj(n)
+	indexer.IndexObjAsync(n)
 	return nil
 }
 
 func (n *Node) Delete() error {
-	if config.Config.UseMySQL {
-		tx, err := data_store.Dbh.Begin()
-		if err != nil {
-			return err
-		}
-		_, err = tx.Exec("DELETE FROM nodes WHERE name = ?", n.Name)
-		if err != nil {
-			terr := tx.Rollback()
-			if terr != nil {
-				err = fmt.Errorf("deleting node %s had an error '%s', and then rolling back the transaction gave another error '%s'", n.Name, err.Error(), terr.Error())
-			}
-			return err
-		}
-		tx.Commit()
-	} else {
-		ds := data_store.New()
-		ds.Delete("node", n.Name)
+	store := n.store
+	if store == nil {
+		store = defaultStore()
 	}
-	indexer.DeleteItemFromCollection("node", n.Name)
+	if err := store.Delete(n.Name); err != nil {
+		return err
+	}
+	indexer.DeleteAsync("node", n.Name)
 	return nil
 }
 
-// Get a list of the nodes on this server.
-func GetList() []string {
-	var node_list []string
-	if config.Config.UseMySQL {
-		rows, err := data_store.Dbh.Query("SELECT name FROM nodes")
+// Get a list of the nodes on this server, optionally from a specific
+// Store rather than the default one -- see Get's store parameter.
+func GetList(store ...Store) []string {
+	return pickStore(store).List()
+}
+
+// Touch updates a node's liveness state in response to a chef-client run
+// or status post. status is whatever the client reported (e.g. "success"
+// or "failure"); LastSuccessfulRun is only advanced for a "success".
+// Touching a node also clears Stale, since hearing from it again means
+// it's obviously not dead.
+func (n *Node) Touch(status string) {
+	n.LastCheckIn = now()
+	n.LastRunStatus = status
+	if status == "success" {
+		n.LastSuccessfulRun = n.LastCheckIn
+	}
+	n.Stale = false
+}
+
+// GetStale returns every node whose last check-in is older than
+// threshold, optionally reading from a specific Store rather than the
+// default one -- see Get's store parameter. It's the basis for both
+// marking nodes stale and, after they've been quiet longer still,
+// reaping them outright.
+func GetStale(threshold time.Duration, store ...Store) []*Node {
+	s := pickStore(store)
+	cutoff := now().Add(-threshold)
+	var stale []*Node
+	for _, name := range GetList(s) {
+		n, err := Get(name, s)
 		if err != nil {
-			if err != sql.ErrNoRows {
-				log.Fatal(err)
-			}
-			rows.Close()
-			return node_list
-		}
-		node_list = make([]string, 0)
-		for rows.Next() {
-			var node_name string
-			err = rows.Scan(&node_name)
-			if err != nil {
-				log.Fatal(err)
-			}
-			node_list = append(node_list, node_name)
+			continue
 		}
-		rows.Close()
-		if err = rows.Err(); err != nil {
-			log.Fatal(err)
+		if n.LastCheckIn.Before(cutoff) {
+			stale = append(stale, n)
 		}
-	} else {
-		ds := data_store.New()
-		node_list = ds.GetList("node")
 	}
-	return node_list
+	return stale
+}
+
+// UsesPolicy reports whether this node's run list and environment should
+// be resolved through a pinned policyfile revision rather than its own
+// RunList/ChefEnvironment, per Chef 12's policyfile semantics.
+func (n *Node) UsesPolicy() bool {
+	return n.PolicyName != "" && n.PolicyGroup != ""
+}
+
+// PolicyRevisionData fetches the policy revision this node is pinned to,
+// for use during run list/cookbook expansion in place of the node's own
+// RunList.
+func (n *Node) PolicyRevisionData() (*policy.Policy, error) {
+	if !n.UsesPolicy() {
+		return nil, fmt.Errorf("node %s is not using a policyfile", n.Name)
+	}
+	return policy.Get(n.PolicyName, n.PolicyGroup)
 }
 
 func (n *Node) GetName() string {
@@ -436,4 +496,95 @@ func (n *Node) Flatten() []string {
 	flatten := util.FlattenObj(n)
 	indexified := util.Indexify(flatten)
 	return indexified
+}
+
+/* Partial search / attribute projection */
+
+// Project resolves each path in paths against the node's attribute
+// trees, walked in Chef's merge precedence: default, then normal, then
+// override, then automatic -- each later tree winning if it also has a
+// value at that path. This is the fast path behind partial search: for
+// a handful of paths it's much cheaper than running the whole node
+// through Flatten() just to throw most of it away. Results are keyed by
+// the path joined with dots (e.g. "cpu.0.mhz").
+func (n *Node) Project(paths [][]string) map[string]interface{} {
+	trees := []map[string]interface{}{n.Default, n.Normal, n.Override, n.Automatic}
+	result := make(map[string]interface{}, len(paths))
+	for _, path := range paths {
+		if len(path) == 0 {
+			continue
+		}
+		var val interface{}
+		found := false
+		for _, tree := range trees {
+			if v, ok := projectPath(tree, path); ok {
+				val = v
+				found = true
+			}
+		}
+		if found {
+			result[strings.Join(path, ".")] = val
+		}
+	}
+	return result
+}
+
+// projectPath walks tree following path, following both
+// map[string]interface{} nodes and, since flattened Chef attributes can
+// nest arrays too, []interface{} nodes addressed by numeric index (e.g.
+// "network.interfaces.0.addresses").
+func projectPath(tree map[string]interface{}, path []string) (interface{}, bool) {
+	var cur interface{} = tree
+	for _, key := range path {
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			v, ok := c[key]
+			if !ok {
+				return nil, false
+			}
+			cur = v
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(c) {
+				return nil, false
+			}
+			cur = c[idx]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// GetMulti bulk-fetches nodes by name, projecting each one down to just
+// the fields the caller asked for. projection maps a result label (the
+// key the caller wants back, e.g. "ip") to the attribute path to pull it
+// from, resolved by Project across the merged attribute trees (e.g.
+// []string{"ipaddress"}; a leading tree name such as "automatic" is not
+// recognized and matches nothing) -- the shape Chef's
+// partial-search protocol POSTs as a search body. This is meant to back
+// a POST /search/{index} handler; like GetList+Get elsewhere in this
+// file, it fetches one node at a time rather than a single bulk query.
+func GetMulti(names []string, projection map[string][]string) []map[string]interface{} {
+	labels := make([]string, 0, len(projection))
+	paths := make([][]string, 0, len(projection))
+	for label, path := range projection {
+		labels = append(labels, label)
+		paths = append(paths, path)
+	}
+
+	results := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		n, err := Get(name)
+		if err != nil {
+			continue
+		}
+		projected := n.Project(paths)
+		row := make(map[string]interface{}, len(projection))
+		for i, label := range labels {
+			row[label] = projected[strings.Join(paths[i], ".")]
+		}
+		results = append(results, row)
+	}
+	return results
 }
\ No newline at end of file
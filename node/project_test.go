@@ -0,0 +1,96 @@
+/* Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package node
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProjectNestedArraysAndMaps(t *testing.T) {
+	n := &Node{
+		Default: map[string]interface{}{
+			"network": map[string]interface{}{
+				"interfaces": []interface{}{
+					map[string]interface{}{"addresses": []interface{}{"10.0.0.1"}},
+				},
+			},
+		},
+		Normal: map[string]interface{}{},
+		Override: map[string]interface{}{},
+		Automatic: map[string]interface{}{
+			"network": map[string]interface{}{
+				"interfaces": []interface{}{
+					map[string]interface{}{"addresses": []interface{}{"192.168.1.1", "192.168.1.2"}},
+				},
+			},
+		},
+	}
+
+	paths := [][]string{
+		{"network", "interfaces", "0", "addresses", "1"},
+		{"network", "interfaces", "0", "addresses", "5"},
+		{"does", "not", "exist"},
+	}
+	got := n.Project(paths)
+
+	want := map[string]interface{}{
+		"network.interfaces.0.addresses.1": "192.168.1.2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Project() = %#v, want %#v", got, want)
+	}
+}
+
+func TestProjectMergePrecedence(t *testing.T) {
+	// default < normal < override < automatic; a later tree should win
+	// wherever it also sets a value, but a path absent from a later tree
+	// should still fall back to an earlier one.
+	n := &Node{
+		Default: map[string]interface{}{
+			"role": "web",
+			"tags": []interface{}{"default-tag"},
+		},
+		Normal: map[string]interface{}{
+			"role": "app",
+		},
+		Override: map[string]interface{}{
+			"role": "db",
+		},
+		Automatic: map[string]interface{}{},
+	}
+
+	got := n.Project([][]string{{"role"}, {"tags", "0"}})
+	want := map[string]interface{}{
+		"role":   "db",
+		"tags.0": "default-tag",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Project() = %#v, want %#v", got, want)
+	}
+}
+
+func TestProjectPathOutOfRangeIndex(t *testing.T) {
+	tree := map[string]interface{}{
+		"list": []interface{}{"a", "b"},
+	}
+	if _, ok := projectPath(tree, []string{"list", "2"}); ok {
+		t.Errorf("expected out-of-range index to miss")
+	}
+	if _, ok := projectPath(tree, []string{"list", "notanumber"}); ok {
+		t.Errorf("expected non-numeric index into an array to miss")
+	}
+}
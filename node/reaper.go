@@ -0,0 +1,83 @@
+/* Node liveness reaper. */
+
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package node
+
+import (
+	"github.com/ctdk/goiardi/config"
+	"github.com/robfig/cron"
+	"log"
+)
+
+// Reaper is a background service that periodically scans for nodes that
+// have gone quiet, marking them stale and eventually deleting the ones
+// that never came back. Without it, autoscaled fleets that terminate
+// instances without ever deregistering them just pile up as dead nodes
+// forever.
+type Reaper struct {
+	c *cron.Cron
+}
+
+// NewReaper builds a Reaper that runs on the schedule given by
+// config.Config.NodeReapInterval (a standard cron spec, e.g. "@every
+// 5m"). Call Start to actually set it going.
+func NewReaper() *Reaper {
+	r := &Reaper{c: cron.New()}
+	if err := r.c.AddFunc(config.Config.NodeReapInterval, r.sweep); err != nil {
+		log.Printf("reaper: bad NodeReapInterval %q, reaper will not run: %s", config.Config.NodeReapInterval, err.Error())
+	}
+	return r
+}
+
+// Start kicks off the reaper's cron schedule in the background.
+func (r *Reaper) Start() {
+	r.c.Start()
+}
+
+// Stop halts the reaper. A sweep already in progress is allowed to
+// finish.
+func (r *Reaper) Stop() {
+	r.c.Stop()
+}
+
+// sweep deletes nodes that have been quiet longer than
+// config.Config.NodeReapAfter, then marks everything else that's been
+// quiet longer than config.Config.NodeStaleAfter as stale.
+func (r *Reaper) sweep() {
+	reaped := make(map[string]bool)
+	for _, n := range GetStale(config.Config.NodeReapAfter) {
+		if err := n.Delete(); err != nil {
+			log.Printf("reaper: failed to delete stale node %s: %s", n.Name, err.Error())
+			continue
+		}
+		reaped[n.Name] = true
+		log.Printf("reaper: deleted node %s after %s of inactivity", n.Name, config.Config.NodeReapAfter)
+	}
+
+	for _, n := range GetStale(config.Config.NodeStaleAfter) {
+		if reaped[n.Name] || n.Stale {
+			continue
+		}
+		n.Stale = true
+		if err := n.Save(); err != nil {
+			log.Printf("reaper: failed to mark node %s stale: %s", n.Name, err.Error())
+			continue
+		}
+		log.Printf("reaper: marked node %s stale after %s of inactivity", n.Name, config.Config.NodeStaleAfter)
+	}
+}
@@ -0,0 +1,154 @@
+/* Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package node
+
+import (
+	"github.com/ctdk/goiardi/config"
+	"testing"
+	"time"
+)
+
+// TestReaperSweep drives sweep() with a fake clock instead of real sleeps:
+// one node is fresh, one is stale-but-not-reapable, and one is old enough
+// to be reaped outright.
+func TestReaperSweep(t *testing.T) {
+	origNow := now
+	defer func() { now = origNow }()
+
+	origReapAfter := config.Config.NodeReapAfter
+	origStaleAfter := config.Config.NodeStaleAfter
+	origInterval := config.Config.NodeReapInterval
+	defer func() {
+		config.Config.NodeReapAfter = origReapAfter
+		config.Config.NodeStaleAfter = origStaleAfter
+		config.Config.NodeReapInterval = origInterval
+	}()
+	config.Config.NodeReapAfter = 2 * time.Hour
+	config.Config.NodeStaleAfter = 1 * time.Hour
+	config.Config.NodeReapInterval = "@every 1h"
+
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+
+	fresh, err := New("reaper-fresh")
+	if err != nil {
+		t.Fatalf("New() returned an error: %s", err.Error())
+	}
+	fresh.Touch("success")
+	if serr := fresh.Save(); serr != nil {
+		t.Fatalf("Save() returned an error: %s", serr.Error())
+	}
+
+	stale, err := New("reaper-stale")
+	if err != nil {
+		t.Fatalf("New() returned an error: %s", err.Error())
+	}
+	stale.Touch("success")
+	if serr := stale.Save(); serr != nil {
+		t.Fatalf("Save() returned an error: %s", serr.Error())
+	}
+
+	reaped, err := New("reaper-reaped")
+	if err != nil {
+		t.Fatalf("New() returned an error: %s", err.Error())
+	}
+	reaped.Touch("success")
+	if serr := reaped.Save(); serr != nil {
+		t.Fatalf("Save() returned an error: %s", serr.Error())
+	}
+
+	// "stale" checks in again at 90 minutes, so by the sweep below it has
+	// been quiet past NodeStaleAfter but not NodeReapAfter.
+	now = func() time.Time { return start.Add(90 * time.Minute) }
+	stale.Touch("success")
+	if serr := stale.Save(); serr != nil {
+		t.Fatalf("Save() returned an error: %s", serr.Error())
+	}
+
+	// Push "reaped", quiet since start, past NodeReapAfter; "fresh" is
+	// touched again just before the sweep, so it should come through
+	// untouched.
+	now = func() time.Time { return start.Add(3 * time.Hour) }
+	fresh.Touch("success")
+	if serr := fresh.Save(); serr != nil {
+		t.Fatalf("Save() returned an error: %s", serr.Error())
+	}
+
+	r := NewReaper()
+	r.sweep()
+
+	gotFresh, err := Get("reaper-fresh")
+	if err != nil {
+		t.Fatalf("expected reaper-fresh to survive the sweep, got error: %s", err.Error())
+	}
+	if gotFresh.Stale {
+		t.Errorf("reaper-fresh should not have been marked stale")
+	}
+
+	gotStale, err := Get("reaper-stale")
+	if err != nil {
+		t.Fatalf("expected reaper-stale to survive the sweep, got error: %s", err.Error())
+	}
+	if !gotStale.Stale {
+		t.Errorf("reaper-stale should have been marked stale")
+	}
+
+	if _, err := Get("reaper-reaped"); err == nil {
+		t.Errorf("expected reaper-reaped to have been deleted by the sweep")
+	}
+}
+
+// TestReaperSweepSparesUnbootstrappedNode covers a node that was just
+// created and has never had Touch called on it -- New() stamps LastCheckIn
+// at creation time specifically so a sweep run moments later doesn't treat
+// it as having gone quiet since Go's zero time and reap it outright.
+func TestReaperSweepSparesUnbootstrappedNode(t *testing.T) {
+	origNow := now
+	defer func() { now = origNow }()
+
+	origReapAfter := config.Config.NodeReapAfter
+	origStaleAfter := config.Config.NodeStaleAfter
+	origInterval := config.Config.NodeReapInterval
+	defer func() {
+		config.Config.NodeReapAfter = origReapAfter
+		config.Config.NodeStaleAfter = origStaleAfter
+		config.Config.NodeReapInterval = origInterval
+	}()
+	config.Config.NodeReapAfter = 2 * time.Hour
+	config.Config.NodeStaleAfter = 1 * time.Hour
+	config.Config.NodeReapInterval = "@every 1h"
+
+	now = func() time.Time { return time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+	n, err := New("reaper-unbootstrapped")
+	if err != nil {
+		t.Fatalf("New() returned an error: %s", err.Error())
+	}
+	if serr := n.Save(); serr != nil {
+		t.Fatalf("Save() returned an error: %s", serr.Error())
+	}
+
+	r := NewReaper()
+	r.sweep()
+
+	got, err := Get("reaper-unbootstrapped")
+	if err != nil {
+		t.Fatalf("expected reaper-unbootstrapped to survive the sweep, got error: %s", err.Error())
+	}
+	if got.Stale {
+		t.Errorf("a freshly created node should not be marked stale moments later")
+	}
+}
@@ -0,0 +1,337 @@
+/* Pluggable node persistence. */
+
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package node
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/data_store"
+	"log"
+	"sync"
+)
+
+// Store is the persistence seam for nodes: MySQL, Postgres, and
+// in-memory all implement it, and New/Save/Delete/GetList go through
+// whichever one applies instead of branching on config.Config.UseMySQL
+// themselves.
+type Store interface {
+	Get(name string) (*Node, error)
+	Put(n *Node) error
+	Delete(name string) error
+	List() []string
+	CheckExists(name string) (bool, error)
+}
+
+// ErrConflict is what Put returns when the node being saved has a
+// ResourceVersion that's no longer current -- the persistence-level
+// signal that Save() turns into a 409 Gerror.
+var ErrConflict = errors.New("node has moved on to a newer resource version since it was last read")
+
+var storeOnce sync.Once
+var theStore Store
+
+// defaultStore picks the Store implementation config.Config calls for,
+// the first time anything needs one, and reuses it afterward.
+func defaultStore() Store {
+	storeOnce.Do(func() {
+		switch {
+		case config.Config.UsePostgreSQL:
+			theStore = &postgresStore{}
+		case config.Config.UseMySQL:
+			theStore = &mysqlStore{}
+		default:
+			theStore = &memStore{}
+		}
+	})
+	return theStore
+}
+
+/* MySQL */
+
+// mysqlStore is the Store backed by the existing MySQL schema. Its
+// methods are the same queries New/Get/Save/Delete/GetList used to run
+// inline, just reorganized behind the Store interface.
+type mysqlStore struct{}
+
+func (s *mysqlStore) CheckExists(name string) (bool, error) {
+	// will need redone if orgs ever get implemented
+	_, err := data_store.CheckForOne(data_store.Dbh, "nodes", name)
+	if err == nil {
+		return true, nil
+	}
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *mysqlStore) Get(name string) (*Node, error) {
+	n := new(Node)
+	stmt, err := data_store.Dbh.Prepare("select n.name, e.name as chef_environment, n.run_list, n.automatic_attr, n.normal_attr, n.default_attr, n.override_attr, n.resource_version, n.last_check_in, n.last_successful_run, n.last_run_status, n.stale, n.policy_name, n.policy_group, n.policy_revision from nodes n join environments as e on n.environment_id = e.id where n.name = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(name)
+	if err := scanNodeRow(n, row); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("node '%s' not found", name)
+		}
+		return nil, err
+	}
+	return n, nil
+}
+
+func (s *mysqlStore) Put(n *Node) error {
+	// prepare the complex structures for saving
+	rlb, err := data_store.EncodeBlob(n.RunList)
+	if err != nil {
+		return err
+	}
+	aab, err := data_store.EncodeBlob(n.Automatic)
+	if err != nil {
+		return err
+	}
+	nab, err := data_store.EncodeBlob(n.Normal)
+	if err != nil {
+		return err
+	}
+	dab, err := data_store.EncodeBlob(n.Default)
+	if err != nil {
+		return err
+	}
+	oab, err := data_store.EncodeBlob(n.Override)
+	if err != nil {
+		return err
+	}
+
+	tx, err := data_store.Dbh.Begin()
+	if err != nil {
+		return err
+	}
+	// This does not use the INSERT ... ON DUPLICATE KEY UPDATE syntax
+	// to keep the MySQL code & the future Postgres code closer
+	// together.
+	node_id, err := data_store.CheckForOne(tx, "nodes", n.Name)
+	if err == nil {
+		// probably want binlog_format set to MIXED or ROW for this
+		// query
+		new_version := n.ResourceVersion + 1
+		res, err := tx.Exec("UPDATE nodes n, environments e SET n.environment_id = e.id, n.run_list = ?, n.automatic_attr = ?, n.normal_attr = ?, n.default_attr = ?, n.override_attr = ?, n.resource_version = ?, n.last_check_in = ?, n.last_successful_run = ?, n.last_run_status = ?, n.stale = ?, n.policy_name = ?, n.policy_group = ?, n.policy_revision = ?, n.updated_at = NOW() WHERE n.id = ? and e.name = ? and n.resource_version = ?", rlb, aab, nab, dab, oab, new_version, n.LastCheckIn, n.LastSuccessfulRun, n.LastRunStatus, n.Stale, n.PolicyName, n.PolicyGroup, n.PolicyRevision, node_id, n.ChefEnvironment, n.ResourceVersion)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if affected, aerr := res.RowsAffected(); aerr == nil && affected == 0 {
+			tx.Rollback()
+			return ErrConflict
+		}
+		n.ResourceVersion = new_version
+	} else {
+		if err != sql.ErrNoRows {
+			tx.Rollback()
+			return err
+		}
+		environment_id, err := data_store.CheckForOne(tx, "environments", n.ChefEnvironment)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		n.ResourceVersion = 1
+		_, err = tx.Exec("INSERT INTO nodes (name, environment_id, run_list, automatic_attr, normal_attr, default_attr, override_attr, resource_version, last_check_in, last_successful_run, last_run_status, stale, policy_name, policy_group, policy_revision, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())", n.Name, environment_id, rlb, aab, nab, dab, oab, n.ResourceVersion, n.LastCheckIn, n.LastSuccessfulRun, n.LastRunStatus, n.Stale, n.PolicyName, n.PolicyGroup, n.PolicyRevision)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	tx.Commit()
+	return nil
+}
+
+func (s *mysqlStore) Delete(name string) error {
+	tx, err := data_store.Dbh.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM nodes WHERE name = ?", name)
+	if err != nil {
+		terr := tx.Rollback()
+		if terr != nil {
+			err = fmt.Errorf("deleting node %s had an error '%s', and then rolling back the transaction gave another error '%s'", name, err.Error(), terr.Error())
+		}
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+func (s *mysqlStore) List() []string {
+	var node_list []string
+	rows, err := data_store.Dbh.Query("SELECT name FROM nodes")
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Fatal(err)
+		}
+		return node_list
+	}
+	defer rows.Close()
+	node_list = make([]string, 0)
+	for rows.Next() {
+		var node_name string
+		if err := rows.Scan(&node_name); err != nil {
+			log.Fatal(err)
+		}
+		node_list = append(node_list, node_name)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return node_list
+}
+
+// scanNodeRow fills n from a row shaped like mysqlStore.Get's query.
+// Kept separate from Get so a future bulk query (an array of rows,
+// rather than one Get call per name) can reuse it.
+func scanNodeRow(n *Node, row *sql.Row) error {
+	var (
+		rl []byte
+		aa []byte
+		na []byte
+		da []byte
+		oa []byte
+	)
+	err := row.Scan(&n.Name, &n.ChefEnvironment, &rl, &aa, &na, &da, &oa, &n.ResourceVersion, &n.LastCheckIn, &n.LastSuccessfulRun, &n.LastRunStatus, &n.Stale, &n.PolicyName, &n.PolicyGroup, &n.PolicyRevision)
+	if err != nil {
+		return err
+	}
+	n.ChefType = "node"
+	n.JsonClass = "Chef::Node"
+	var q interface{}
+	q, err = data_store.DecodeBlob(rl, n.RunList)
+	if err != nil {
+		return err
+	}
+	n.RunList = q.([]string)
+	q, err = data_store.DecodeBlob(aa, n.Automatic)
+	if err != nil {
+		return err
+	}
+	n.Automatic = q.(map[string]interface{})
+	q, err = data_store.DecodeBlob(na, n.Normal)
+	if err != nil {
+		return err
+	}
+	n.Normal = q.(map[string]interface{})
+	q, err = data_store.DecodeBlob(da, n.Default)
+	if err != nil {
+		return err
+	}
+	n.Default = q.(map[string]interface{})
+	q, err = data_store.DecodeBlob(oa, n.Override)
+	if err != nil {
+		return err
+	}
+	n.Override = q.(map[string]interface{})
+	data_store.ChkNilArray(n)
+	return nil
+}
+
+/* In-memory */
+
+// memStore is the Store backed by the package-wide in-memory
+// data_store, used when neither config.Config.UseMySQL nor
+// config.Config.UsePostgreSQL is set.
+type memStore struct {
+	mu sync.Mutex
+}
+
+func (s *memStore) CheckExists(name string) (bool, error) {
+	ds := data_store.New()
+	_, found := ds.Get("node", name)
+	return found, nil
+}
+
+func (s *memStore) Get(name string) (*Node, error) {
+	ds := data_store.New()
+	n, found := ds.Get("node", name)
+	if !found {
+		return nil, fmt.Errorf("node '%s' not found", name)
+	}
+	// Hand back a copy, not the pointer sitting in the map: two callers
+	// fetching the same node must get independent *Node values, or the
+	// ResourceVersion check in Put below can never fail -- they'd just
+	// be comparing the stored node against itself.
+	stored := *n.(*Node)
+	return &stored, nil
+}
+
+func (s *memStore) Put(n *Node) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ds := data_store.New()
+	if existing, found := ds.Get("node", n.Name); found {
+		if existing.(*Node).ResourceVersion != n.ResourceVersion {
+			return ErrConflict
+		}
+	}
+	n.ResourceVersion++
+	ds.Set("node", n.Name, n)
+	return nil
+}
+
+func (s *memStore) Delete(name string) error {
+	ds := data_store.New()
+	ds.Delete("node", name)
+	return nil
+}
+
+func (s *memStore) List() []string {
+	ds := data_store.New()
+	return ds.GetList("node")
+}
+
+/* Postgres */
+
+// postgresStore is a placeholder Store for Postgres-backed goiardi
+// installs. None of the actual SQL has been written yet; this just
+// gives the "add Postgres later" TODOs that used to be sprinkled
+// through node.go a single, obvious home to land in once it is.
+type postgresStore struct{}
+
+func (s *postgresStore) CheckExists(name string) (bool, error) {
+	return false, fmt.Errorf("postgres support is not implemented yet")
+}
+
+func (s *postgresStore) Get(name string) (*Node, error) {
+	return nil, fmt.Errorf("postgres support is not implemented yet")
+}
+
+func (s *postgresStore) Put(n *Node) error {
+	return fmt.Errorf("postgres support is not implemented yet")
+}
+
+func (s *postgresStore) Delete(name string) error {
+	return fmt.Errorf("postgres support is not implemented yet")
+}
+
+func (s *postgresStore) List() []string {
+	return nil
+}
@@ -0,0 +1,156 @@
+/* Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package node
+
+import (
+	"fmt"
+	"github.com/ctdk/goiardi/util"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentSaveConflicts exercises the OCC guard on the in-memory
+// Store: two goroutines that both read the same node and then try to
+// save their own changes must not both succeed -- exactly one should
+// win, and the other should come back as a 409 conflict.
+func TestConcurrentSaveConflicts(t *testing.T) {
+	n, err := New("conflict-test")
+	if err != nil {
+		t.Fatalf("New() returned an error: %s", err.Error())
+	}
+	if serr := n.Save(); serr != nil {
+		t.Fatalf("initial Save() returned an error: %s", serr.Error())
+	}
+
+	first, gerr := Get(n.Name)
+	if gerr != nil {
+		t.Fatalf("first Get() returned an error: %s", gerr.Error())
+	}
+	second, gerr := Get(n.Name)
+	if gerr != nil {
+		t.Fatalf("second Get() returned an error: %s", gerr.Error())
+	}
+	first.Normal["from"] = "first"
+	second.Normal["from"] = "second"
+
+	var wg sync.WaitGroup
+	results := make([]util.Gerror, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		results[0] = first.Save()
+	}()
+	go func() {
+		defer wg.Done()
+		results[1] = second.Save()
+	}()
+	wg.Wait()
+
+	var succeeded, conflicted int
+	for _, r := range results {
+		switch {
+		case r == nil:
+			succeeded++
+		case r.Status() == http.StatusConflict:
+			conflicted++
+		default:
+			t.Fatalf("unexpected error from Save(): %s", r.Error())
+		}
+	}
+	if succeeded != 1 || conflicted != 1 {
+		t.Fatalf("expected exactly one Save() to succeed and one to conflict with 409, got %d successes and %d conflicts", succeeded, conflicted)
+	}
+}
+
+// fakeStore is a Store entirely separate from defaultStore()'s backing
+// data_store, used to prove that Get/GetList/GetStale actually read from
+// the store they're given instead of always falling back to the
+// process-wide default.
+type fakeStore struct {
+	nodes map[string]*Node
+}
+
+func (s *fakeStore) CheckExists(name string) (bool, error) {
+	_, found := s.nodes[name]
+	return found, nil
+}
+
+func (s *fakeStore) Get(name string) (*Node, error) {
+	n, found := s.nodes[name]
+	if !found {
+		return nil, fmt.Errorf("node '%s' not found", name)
+	}
+	stored := *n
+	return &stored, nil
+}
+
+func (s *fakeStore) Put(n *Node) error {
+	n.ResourceVersion++
+	s.nodes[n.Name] = n
+	return nil
+}
+
+func (s *fakeStore) Delete(name string) error {
+	delete(s.nodes, name)
+	return nil
+}
+
+func (s *fakeStore) List() []string {
+	names := make([]string, 0, len(s.nodes))
+	for name := range s.nodes {
+		names = append(names, name)
+	}
+	return names
+}
+
+// TestGetThroughCustomStore confirms a node saved against a Store passed
+// via WithStore can actually be read back through that same store with
+// Get/GetList -- not just through the process-wide defaultStore().
+func TestGetThroughCustomStore(t *testing.T) {
+	s := &fakeStore{nodes: make(map[string]*Node)}
+
+	n, err := New("custom-store-test", WithStore(s))
+	if err != nil {
+		t.Fatalf("New() returned an error: %s", err.Error())
+	}
+	if serr := n.Save(); serr != nil {
+		t.Fatalf("Save() returned an error: %s", serr.Error())
+	}
+
+	if _, derr := Get("custom-store-test"); derr == nil {
+		t.Fatalf("expected the default store to have no knowledge of a node saved to a custom store")
+	}
+
+	got, gerr := Get("custom-store-test", s)
+	if gerr != nil {
+		t.Fatalf("Get() through the custom store returned an error: %s", gerr.Error())
+	}
+	if got.Name != n.Name {
+		t.Fatalf("got node %q, want %q", got.Name, n.Name)
+	}
+
+	list := GetList(s)
+	found := false
+	for _, name := range list {
+		if name == "custom-store-test" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("GetList() through the custom store should have included custom-store-test, got %v", list)
+	}
+}
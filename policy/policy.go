@@ -0,0 +1,104 @@
+/* Policyfile object/class, for Chef 12 policyfile support. */
+
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package policy stores uploaded policyfile revisions. It's a skeleton:
+// enough to let a node pinned to a policy_name/policy_group look up the
+// run list and cookbook locks it should expand against, in place of its
+// chef_environment's run list. SQL-backed storage isn't implemented yet,
+// only the in-memory data_store path (node/store.go's postgresStore is
+// a placeholder for the same reason).
+package policy
+
+import (
+	"fmt"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/data_store"
+	"github.com/ctdk/goiardi/util"
+)
+
+// Policy is a single uploaded revision of a policyfile: the run list and
+// cookbook locks it pins, scoped to a policy group (e.g. "production").
+type Policy struct {
+	Name string `json:"name"`
+	Group string `json:"policy_group"`
+	Revision string `json:"revision_id"`
+	RunList []string `json:"run_list"`
+	CookbookLocks map[string]interface{} `json:"cookbook_locks"`
+}
+
+// key is how a policy revision is addressed in the data_store: a given
+// name only has one active revision per group.
+func key(name, group string) string {
+	return fmt.Sprintf("%s-%s", group, name)
+}
+
+// New creates a new policy revision for the given name/group. Use Save to
+// persist it once its run list and cookbook locks are filled in.
+func New(name string, group string, revision string) (*Policy, util.Gerror) {
+	if !util.ValidateDBagName(name) {
+		return nil, util.Errorf("Field 'name' invalid")
+	}
+	p := &Policy{
+		Name: name,
+		Group: group,
+		Revision: revision,
+		RunList: []string{},
+		CookbookLocks: map[string]interface{}{},
+	}
+	return p, nil
+}
+
+// Get fetches the policy revision currently pinned for this name/group.
+// This is what node expansion consults when a node has
+// PolicyName/PolicyGroup set, in place of its chef_environment's run
+// list.
+func Get(name string, group string) (*Policy, error) {
+	if config.Config.UseMySQL {
+		// TODO: Postgres/MySQL-backed storage for policy revisions.
+		return nil, fmt.Errorf("policy storage is not yet implemented in SQL mode")
+	}
+	ds := data_store.New()
+	p, found := ds.Get("policy", key(name, group))
+	if !found {
+		return nil, fmt.Errorf("policy '%s' in group '%s' not found", name, group)
+	}
+	return p.(*Policy), nil
+}
+
+// Save persists this policy revision so it can be consulted during node
+// expansion.
+func (p *Policy) Save() error {
+	if config.Config.UseMySQL {
+		// TODO: Postgres/MySQL-backed storage for policy revisions.
+		return fmt.Errorf("policy storage is not yet implemented in SQL mode")
+	}
+	ds := data_store.New()
+	ds.Set("policy", key(p.Name, p.Group), p)
+	return nil
+}
+
+// Delete removes a policy revision.
+func (p *Policy) Delete() error {
+	if config.Config.UseMySQL {
+		// TODO: Postgres/MySQL-backed storage for policy revisions.
+		return fmt.Errorf("policy storage is not yet implemented in SQL mode")
+	}
+	ds := data_store.New()
+	ds.Delete("policy", key(p.Name, p.Group))
+	return nil
+}